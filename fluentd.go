@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// defaultFluentdTag derives a reasonable -tag default from the local
+// hostname, falling back to a fixed name if the hostname can't be read.
+func defaultFluentdTag() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "json2msgpack"
+	}
+	return "json2msgpack." + host
+}
+
+// FluentdForwarder ships records to a Fluentd/Fluent Bit collector over
+// TCP using the Fluentd Forward protocol: a msgpack array of
+// [tag, timestamp, record] per event, or [tag, [[ts, record], ...]] when
+// BatchSize/BatchInterval buffering is enabled. It reconnects with
+// exponential backoff whenever a write to the collector fails.
+type FluentdForwarder struct {
+	Address string
+	Tag     string
+
+	// BatchSize and BatchInterval enable buffering: entries accumulate
+	// until either bound is reached, at which point Flush is called
+	// automatically. Both bounds are checked only inside Send, so a
+	// partial batch is not flushed by the passage of time alone; it waits
+	// for the next Send, Flush, or Close. Leave both zero to forward
+	// every record immediately.
+	BatchSize     int
+	BatchInterval time.Duration
+
+	conn net.Conn
+	mh   codec.MsgpackHandle
+
+	batch     [][2]interface{}
+	lastFlush time.Time
+}
+
+// NewFluentdForwarder returns a forwarder for address; the TCP connection
+// is opened lazily on the first Send or Flush.
+func NewFluentdForwarder(address, tag string, batchSize int, batchInterval time.Duration) *FluentdForwarder {
+	f := &FluentdForwarder{
+		Address:       address,
+		Tag:           tag,
+		BatchSize:     batchSize,
+		BatchInterval: batchInterval,
+		lastFlush:     time.Now(),
+	}
+	f.mh.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return f
+}
+
+// Send forwards one (timestamp, record) event, tagged with f.Tag. When
+// batching is enabled the event is buffered; otherwise it is written
+// immediately as its own Forward message.
+func (f *FluentdForwarder) Send(ts int64, record interface{}) error {
+	if f.BatchSize <= 0 && f.BatchInterval <= 0 {
+		return f.write([]interface{}{f.Tag, ts, record})
+	}
+
+	f.batch = append(f.batch, [2]interface{}{ts, record})
+	if (f.BatchSize > 0 && len(f.batch) >= f.BatchSize) ||
+		(f.BatchInterval > 0 && time.Since(f.lastFlush) >= f.BatchInterval) {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Flush writes any buffered events as a single batched Forward message.
+// It is a no-op if nothing is buffered.
+func (f *FluentdForwarder) Flush() error {
+	if len(f.batch) == 0 {
+		return nil
+	}
+
+	entries := make([]interface{}, len(f.batch))
+	for i, e := range f.batch {
+		entries[i] = []interface{}{e[0], e[1]}
+	}
+
+	err := f.write([]interface{}{f.Tag, entries})
+	f.batch = f.batch[:0]
+	f.lastFlush = time.Now()
+	return err
+}
+
+// Close flushes any buffered events and closes the underlying connection.
+func (f *FluentdForwarder) Close() error {
+	err := f.Flush()
+	if f.conn != nil {
+		if cerr := f.conn.Close(); err == nil {
+			err = cerr
+		}
+		f.conn = nil
+	}
+	return err
+}
+
+// maxWriteAttempts bounds how many times in all write tries a single
+// message, the first try included, before giving up.
+const maxWriteAttempts = 3
+
+// write encodes msg as msgpack and sends it to the collector, connecting
+// (or reconnecting, with backoff) as needed. A failed write drops the
+// connection and tries again against a new one, up to maxWriteAttempts
+// tries in all,
+// so a mid-stream disconnect is recovered from instead of surfacing as a
+// hard error for this message.
+func (f *FluentdForwarder) write(msg interface{}) error {
+	var lastErr error
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		if err := f.connect(); err != nil {
+			lastErr = err
+			continue
+		}
+
+		enc := codec.NewEncoder(f.conn, &f.mh)
+		if err := enc.Encode(msg); err != nil {
+			f.conn.Close()
+			f.conn = nil
+			lastErr = fmt.Errorf("write to '%s' failed: %s", f.Address, err)
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("fluentd: giving up after %d attempt(s): %s", maxWriteAttempts, lastErr)
+}
+
+func (f *FluentdForwarder) connect() error {
+	if f.conn != nil {
+		return nil
+	}
+
+	var err error
+	backoff := 100 * time.Millisecond
+	for attempt := 0; attempt < 5; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		f.conn, err = net.Dial("tcp", f.Address)
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("fluentd: could not connect to '%s' after %d attempts: %s", f.Address, 5, err)
+}
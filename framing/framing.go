@@ -0,0 +1,316 @@
+/*
+Package framing implements the length-prefixed msgpack binary-array
+framing shared by json2msgpack and msgpackParseBench.
+
+Each frame on the wire is a msgpack variable length binary array
+(bin8/bin16/bin32), whose payload is one msgpack-encoded record. The
+header adds only 2-5 bytes per frame. FrameWriter and FrameReader wrap
+an arbitrary io.Writer/io.Reader so library users can produce or consume
+this framing without vendoring any of the json2msgpack command main
+packages.
+*/
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// preamble is written once, as the very first bytes of a stream, only
+// when compression is enabled. Its leading 0x00 can never be mistaken
+// for a bin8/bin16/bin32 header byte (0xc4/0xc5/0xc6), so FrameReader can
+// always tell a compressed stream from a plain one by peeking it. Its
+// presence tells FrameReader that every frame's payload begins with a
+// 1-byte Codec tag; its absence means the stream is plain, uncompressed
+// frames exactly as before compression support existed.
+var preamble = []byte{0x00, 'F', 'R', 'M', 'C'}
+
+// WriteBinArrayHeader writes the 2-5 byte msgpack bin array header for a
+// payload of length l. The caller is responsible for writing the l bytes
+// of payload immediately afterwards.
+func WriteBinArrayHeader(w io.Writer, l uint32) error {
+	var by [8]byte
+	var nBytesAdded int
+	if l < 256 {
+		by[0] = 0xc4 // msgpackBin8
+		by[1] = uint8(l)
+		nBytesAdded = 2
+	} else if l < 65536 {
+		by[0] = 0xc5 // msgpackBin16
+		binary.BigEndian.PutUint16(by[1:3], uint16(l))
+		nBytesAdded = 3
+	} else {
+		by[0] = 0xc6 // msgpackBin32
+		binary.BigEndian.PutUint32(by[1:5], l)
+		nBytesAdded = 5
+	}
+	_, err := w.Write(by[:nBytesAdded])
+	return err
+}
+
+// headerLenForTag returns the total size of a msgpack bin array header
+// that begins with tag (2 for bin8, 3 for bin16, 5 for bin32), so callers
+// that only have the first peeked byte can size a read before parsing the
+// header with DecodeBinArrayHeader.
+func headerLenForTag(tag byte) (int, error) {
+	switch tag {
+	case 0xc4: // msgpackBin8
+		return 2, nil
+	case 0xc5: // msgpackBin16
+		return 3, nil
+	case 0xc6: // msgpackBin32
+		return 5, nil
+	default:
+		return 0, fmt.Errorf("framing: unexpected frame header byte 0x%x", tag)
+	}
+}
+
+// DecodeBinArrayHeader parses the msgpack bin array header at the start
+// of p, returning the size of the header itself, the payload size it
+// announces, and their sum.
+func DecodeBinArrayHeader(p []byte) (headerSize int, payloadSize int, totalFrameSize int, err error) {
+	lenp := len(p)
+	if lenp < 1 {
+		err = fmt.Errorf("framing.DecodeBinArrayHeader error: p is empty")
+		return
+	}
+
+	switch p[0] {
+	case 0xc4: // msgpackBin8
+		if lenp < 2 {
+			err = fmt.Errorf("framing.DecodeBinArrayHeader error: p len (%d) too small", lenp)
+			return
+		}
+		headerSize = 2
+		payloadSize = int(p[1])
+	case 0xc5: // msgpackBin16
+		if lenp < 3 {
+			err = fmt.Errorf("framing.DecodeBinArrayHeader error: p len (%d) too small", lenp)
+			return
+		}
+		headerSize = 3
+		payloadSize = int(binary.BigEndian.Uint16(p[1:3]))
+	case 0xc6: // msgpackBin32
+		if lenp < 5 {
+			err = fmt.Errorf("framing.DecodeBinArrayHeader error: p len (%d) too small", lenp)
+			return
+		}
+		headerSize = 5
+		payloadSize = int(binary.BigEndian.Uint32(p[1:5]))
+	default:
+		err = fmt.Errorf("framing.DecodeBinArrayHeader error: unexpected header byte 0x%x", p[0])
+		return
+	}
+
+	totalFrameSize = headerSize + payloadSize
+	return
+}
+
+// FrameWriter writes length-prefixed msgpack frames to an underlying
+// io.Writer.
+//
+// EncodeFrame is safe to call from multiple goroutines sharing one
+// FrameWriter (as pipeline.go's workers do): zstdMu guards the
+// lazily-built zstd.Encoder that CodecZstd reuses across frames.
+// WriteFrame writes to the underlying io.Writer without locking, so
+// concurrent WriteFrame calls are only safe if that writer is.
+type FrameWriter struct {
+	w     io.Writer
+	codec Codec
+
+	zstdMu  sync.Mutex
+	zstdEnc *zstd.Encoder
+}
+
+// NewFrameWriter wraps w so that WriteFrame can be used to emit framed
+// records to it. Frames are written uncompressed, exactly as before
+// compression support existed, with no preamble.
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// NewCompressedFrameWriter wraps w like NewFrameWriter, but compresses
+// every frame's payload with codec before framing it. Unless codec is
+// CodecRaw, a magic-byte preamble is written immediately so that
+// FrameReader can auto-detect the mode.
+func NewCompressedFrameWriter(w io.Writer, codec Codec) (*FrameWriter, error) {
+	fw := &FrameWriter{w: w, codec: codec}
+	if codec != CodecRaw {
+		if _, err := w.Write(preamble); err != nil {
+			return nil, err
+		}
+	}
+	return fw, nil
+}
+
+// minCompressPayload is the smallest payload EncodeFrame will even try to
+// compress. Every codec here carries a few bytes to tens of bytes of
+// fixed framing/header overhead of its own, so compressing the short
+// records (single JSON log lines) this tool usually frames tends to grow
+// them instead of shrinking them; below this size it isn't worth paying
+// the CPU cost to find that out.
+const minCompressPayload = 256
+
+// EncodeFrame returns the complete encoded frame for payload - a bin
+// array header followed by the (optionally codec-tagged and compressed)
+// bytes of payload - without writing it anywhere. It's exposed so callers
+// that must serialize their own writes, such as a concurrent pipeline
+// with worker goroutines feeding a single writer goroutine, can prepare
+// frames off the hot write path and hand over only the final bytes.
+//
+// A per-stream codec (set via NewCompressedFrameWriter) is only ever
+// applied per frame when it actually pays off: payloads shorter than
+// minCompressPayload skip compression outright, and any payload whose
+// compressed form isn't actually smaller falls back to being stored raw,
+// tagged CodecRaw, rather than paying the compressor's overhead for
+// nothing.
+func (fw *FrameWriter) EncodeFrame(payload []byte) ([]byte, error) {
+	body := payload
+	if fw.codec != CodecRaw {
+		frameCodec := CodecRaw
+		stored := payload
+		if len(payload) >= minCompressPayload {
+			compressed, err := fw.compress(payload)
+			if err != nil {
+				return nil, err
+			}
+			if len(compressed) < len(payload) {
+				frameCodec = fw.codec
+				stored = compressed
+			}
+		}
+		body = append([]byte{byte(frameCodec)}, stored...)
+	}
+
+	if len(body) > 4294967295 {
+		return nil, fmt.Errorf("framing.EncodeFrame error: frame of %d bytes exceeds maximum frame size", len(body))
+	}
+
+	var hdr bytes.Buffer
+	if err := WriteBinArrayHeader(&hdr, uint32(len(body))); err != nil {
+		return nil, err
+	}
+	return append(hdr.Bytes(), body...), nil
+}
+
+// WriteFrame writes payload as one framed record: a bin array header
+// followed by the (optionally codec-tagged and compressed) bytes of
+// payload. The header's length reflects the size actually written after
+// compression, not the size of payload itself.
+func (fw *FrameWriter) WriteFrame(payload []byte) error {
+	frame, err := fw.EncodeFrame(payload)
+	if err != nil {
+		return err
+	}
+	_, err = fw.w.Write(frame)
+	return err
+}
+
+// FrameReader reads length-prefixed msgpack frames from an underlying
+// io.Reader, transparently decompressing them if the stream carries the
+// compression preamble written by NewCompressedFrameWriter.
+//
+// FrameReader is not safe for concurrent use - like bufio.Reader, Next
+// must only be called by a single goroutine at a time, so the lazily-
+// built zstd.Decoder it reuses across frames needs no locking of its
+// own.
+type FrameReader struct {
+	r          *bufio.Reader
+	compressed bool
+
+	zstdDec *zstd.Decoder
+}
+
+// NewFrameReader wraps r so that Next can be used to iterate the framed
+// records read from it. It auto-detects whether r was written by
+// NewCompressedFrameWriter by peeking for the magic-byte preamble.
+func NewFrameReader(r io.Reader) *FrameReader {
+	br := bufio.NewReader(r)
+	fr := &FrameReader{r: br}
+
+	if peeked, err := br.Peek(len(preamble)); err == nil && bytes.Equal(peeked, preamble) {
+		br.Discard(len(preamble))
+		fr.compressed = true
+	}
+
+	return fr
+}
+
+// NewFrameReaderAt wraps r, which must already be positioned at the
+// start of a frame header (for example via an Index lookup rather than
+// the start of the stream), so the preamble auto-detection NewFrameReader
+// relies on can't run. Callers that seek into the middle of an archive
+// must instead learn whether it's compressed some other way (such as
+// peeking the first few bytes before seeking) and pass it as compressed.
+func NewFrameReaderAt(r io.Reader, compressed bool) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r), compressed: compressed}
+}
+
+// DetectCompressed reports whether r, read from its current position,
+// begins with the magic-byte preamble NewCompressedFrameWriter writes for
+// a compressed archive. It restores r's position before returning, so
+// callers can use it before seeking elsewhere in the same file.
+func DetectCompressed(r io.ReadSeeker) (bool, error) {
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+
+	buf := make([]byte, len(preamble))
+	n, err := io.ReadFull(r, buf)
+	if _, serr := r.Seek(pos, io.SeekStart); serr != nil {
+		return false, serr
+	}
+	if err != nil {
+		// fewer bytes than the preamble means it can't be present.
+		return false, nil
+	}
+
+	return n == len(preamble) && bytes.Equal(buf, preamble), nil
+}
+
+// Next reads and returns the payload of the next frame, decompressing it
+// first if the stream is compressed. It returns io.EOF, with a nil
+// payload, once the underlying reader is exhausted cleanly between
+// frames.
+func (fr *FrameReader) Next() ([]byte, error) {
+	head, err := fr.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	headerLen, err := headerLenForTag(head[0])
+	if err != nil {
+		return nil, fmt.Errorf("framing.FrameReader.Next error: %s", err)
+	}
+
+	hdr := make([]byte, headerLen)
+	if _, err := io.ReadFull(fr.r, hdr); err != nil {
+		return nil, err
+	}
+
+	_, payloadSize, _, err := DecodeBinArrayHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, payloadSize)
+	if _, err := io.ReadFull(fr.r, body); err != nil {
+		return nil, err
+	}
+
+	if !fr.compressed {
+		return body, nil
+	}
+
+	if len(body) < 1 {
+		return nil, fmt.Errorf("framing.FrameReader.Next error: compressed frame is missing its codec byte")
+	}
+	return fr.decompress(Codec(body[0]), body[1:])
+}
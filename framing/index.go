@@ -0,0 +1,236 @@
+package framing
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// idxMagic identifies a json2msgpack .idx sidecar file.
+var idxMagic = []byte{'J', 'M', 'I', 'X'}
+
+const idxVersion = 1
+
+// idxBlockSize is how many consecutive frame entries share one absolute
+// anchor offset in the sidecar's on-disk encoding; every other entry in
+// the block stores only the varint delta from the previous frame's
+// offset, keeping the sidecar small for long archives without requiring
+// a full absolute offset per frame.
+const idxBlockSize = 1024
+
+// Index holds, for every frame in a framed msgpack archive, the byte
+// offset where the frame's header begins and its total size (header plus
+// payload), so FrameAt can seek straight to frame n without reading the
+// frames before it.
+type Index struct {
+	offsets []int64
+	sizes   []int64
+}
+
+// BuildIndex scans every frame in r from the start, via
+// DecodeBinArrayHeader, and returns an Index recording each frame's
+// offset and total size. It does not attempt to decompress payloads, so
+// it works the same whether r holds raw or compressed frames; r is left
+// positioned at EOF.
+func BuildIndex(r io.ReadSeeker) (*Index, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+
+	offset, err := skipPreamble(br)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &Index{}
+	for {
+		head, err := br.Peek(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		headerLen, err := headerLenForTag(head[0])
+		if err != nil {
+			return nil, fmt.Errorf("framing.BuildIndex error: %s (at offset %d)", err, offset)
+		}
+
+		hdr := make([]byte, headerLen)
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			return nil, err
+		}
+
+		_, payloadSize, totalFrameSize, err := DecodeBinArrayHeader(hdr)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := io.CopyN(ioutil.Discard, br, int64(payloadSize)); err != nil {
+			return nil, err
+		}
+
+		idx.offsets = append(idx.offsets, offset)
+		idx.sizes = append(idx.sizes, int64(totalFrameSize))
+		offset += int64(totalFrameSize)
+	}
+
+	return idx, nil
+}
+
+// skipPreamble advances past the compression preamble if br starts with
+// one, returning the stream offset immediately after it (0 if absent).
+func skipPreamble(br *bufio.Reader) (int64, error) {
+	peeked, err := br.Peek(len(preamble))
+	if err != nil {
+		// a short stream (fewer bytes than the preamble) can't be
+		// compressed; let the caller's frame-header peek report EOF.
+		return 0, nil
+	}
+	if !bytesEqual(peeked, preamble) {
+		return 0, nil
+	}
+	if _, err := br.Discard(len(preamble)); err != nil {
+		return 0, err
+	}
+	return int64(len(preamble)), nil
+}
+
+func bytesEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// FrameAt returns the byte offset and total size (header plus payload)
+// of frame n, where n is a 0-based frame number. It panics if n is out
+// of range, matching slice indexing semantics.
+func (idx *Index) FrameAt(n int) (offset, size int64) {
+	return idx.offsets[n], idx.sizes[n]
+}
+
+// FrameCount returns the number of frames recorded in idx.
+func (idx *Index) FrameCount() int {
+	return len(idx.offsets)
+}
+
+// WriteIndex serializes idx to w as a .idx sidecar: a
+// {magic, version, frameCount, entryStride} header, followed by the
+// frames' sizes and offsets packed into blocks of entryStride entries.
+// Each block starts with an absolute anchor offset; the remaining
+// entries in the block store only the varint delta from the previous
+// frame's offset.
+func WriteIndex(w io.Writer, idx *Index) error {
+	bw := bufio.NewWriter(w)
+
+	if _, err := bw.Write(idxMagic); err != nil {
+		return err
+	}
+	if err := bw.WriteByte(idxVersion); err != nil {
+		return err
+	}
+
+	var scratch [binary.MaxVarintLen64]byte
+	writeUvarint := func(v uint64) error {
+		n := binary.PutUvarint(scratch[:], v)
+		_, err := bw.Write(scratch[:n])
+		return err
+	}
+
+	if err := writeUvarint(uint64(len(idx.offsets))); err != nil {
+		return err
+	}
+	if err := writeUvarint(uint64(idxBlockSize)); err != nil {
+		return err
+	}
+
+	var prevOffset int64
+	for i, offset := range idx.offsets {
+		if i%idxBlockSize == 0 {
+			if err := writeUvarint(uint64(offset)); err != nil {
+				return err
+			}
+		} else {
+			if err := writeUvarint(uint64(offset - prevOffset)); err != nil {
+				return err
+			}
+		}
+		if err := writeUvarint(uint64(idx.sizes[i])); err != nil {
+			return err
+		}
+		prevOffset = offset
+	}
+
+	return bw.Flush()
+}
+
+// ReadIndex deserializes a .idx sidecar previously written by WriteIndex.
+func ReadIndex(r io.Reader) (*Index, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(idxMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, fmt.Errorf("framing.ReadIndex error: %s", err)
+	}
+	if !bytesEqual(magic, idxMagic) {
+		return nil, fmt.Errorf("framing.ReadIndex error: not a json2msgpack .idx file (bad magic)")
+	}
+
+	version, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != idxVersion {
+		return nil, fmt.Errorf("framing.ReadIndex error: unsupported .idx version %d", version)
+	}
+
+	frameCount, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	entryStride, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &Index{
+		offsets: make([]int64, 0, frameCount),
+		sizes:   make([]int64, 0, frameCount),
+	}
+
+	var prevOffset int64
+	for i := uint64(0); i < frameCount; i++ {
+		v, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+
+		var offset int64
+		if i%entryStride == 0 {
+			offset = int64(v)
+		} else {
+			offset = prevOffset + int64(v)
+		}
+
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+
+		idx.offsets = append(idx.offsets, offset)
+		idx.sizes = append(idx.sizes, int64(size))
+		prevOffset = offset
+	}
+
+	return idx, nil
+}
@@ -0,0 +1,244 @@
+/*
+json2msgpack-gen: generate a reflection-free EncodeMsg method (and a
+schema.NewFunc-compatible New function) for the first exported struct
+type, with supported fields, declared in a Go source file, so
+json2msgpack's -schema mode can encode known-shape records without going
+through interface{} and reflection. Any later struct types in the file
+are ignored.
+
+Only exported fields of type string, int, int64, float64, and bool are
+supported; other fields are skipped. This mirrors, at much smaller scale,
+how tinylib/msgp generates MarshalMsg/UnmarshalMsg methods from plain Go
+struct definitions.
+*/
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path"
+	"text/template"
+)
+
+var ProgramName string = path.Base(os.Args[0])
+
+type GenConfig struct {
+	InputPath  string
+	OutputPath string
+}
+
+// call DefineFlags before myflags.Parse()
+func (c *GenConfig) DefineFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.InputPath, "input", "", "path to the .go file declaring the target struct(s)")
+	fs.StringVar(&c.OutputPath, "output", "", "path to write the generated _gen.go file to (defaults to <input base>_gen.go)")
+}
+
+// call c.ValidateConfig() after myflags.Parse()
+func (c *GenConfig) ValidateConfig() error {
+	if c.InputPath == "" {
+		return fmt.Errorf("-input is required")
+	}
+	if !FileExists(c.InputPath) {
+		return fmt.Errorf("-input path '%s' does not exist", c.InputPath)
+	}
+	if c.OutputPath == "" {
+		c.OutputPath = c.InputPath[:len(c.InputPath)-len(".go")] + "_gen.go"
+	}
+	return nil
+}
+
+// demonstrate the sequence of calls to DefineFlags() and ValidateConfig()
+func main() {
+	myflags := flag.NewFlagSet("json2msgpack-gen", flag.ExitOnError)
+	cfg := &GenConfig{}
+	cfg.DefineFlags(myflags)
+
+	err := myflags.Parse(os.Args[1:])
+	err = cfg.ValidateConfig()
+	if err != nil {
+		log.Fatalf("%s error: '%s'", ProgramName, err)
+	}
+
+	if err := generate(cfg); err != nil {
+		log.Fatalf("%s error: '%s'", ProgramName, err)
+	}
+}
+
+// structField is one supported field of a target struct.
+type structField struct {
+	Name       string
+	Writer     string // the schema.Write* helper to call for this field's type
+	EncodeExpr string // Go expression, in terms of v, passed to Writer
+	Decode     string // Go expression, "decoded, ok", asserting raw into this field's type
+}
+
+// targetStruct is one struct type found in the schema file, with its
+// supported fields in declaration order.
+type targetStruct struct {
+	Name   string
+	Fields []structField
+}
+
+func generate(cfg *GenConfig) error {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, cfg.InputPath, nil, 0)
+	if err != nil {
+		return fmt.Errorf("parsing '%s': %s", cfg.InputPath, err)
+	}
+
+	structs := findStructs(file)
+	if len(structs) == 0 {
+		return fmt.Errorf("'%s' declares no exported struct types with supported fields", cfg.InputPath)
+	}
+
+	// json2msgpack-gen targets one schema struct per file; if more than
+	// one is declared, the first (in source order) wins.
+	target := structs[0]
+
+	var buf bytes.Buffer
+	if err := genTemplate.Execute(&buf, struct {
+		Package string
+		Struct  targetStruct
+	}{
+		Package: file.Name.Name,
+		Struct:  target,
+	}); err != nil {
+		return fmt.Errorf("rendering generated code: %s", err)
+	}
+
+	if err := os.WriteFile(cfg.OutputPath, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("writing '%s': %s", cfg.OutputPath, err)
+	}
+
+	return nil
+}
+
+// findStructs collects every exported struct type in file along with
+// its supported (string/int/int64/float64/bool) exported fields, in
+// declaration order.
+func findStructs(file *ast.File) []targetStruct {
+	var out []targetStruct
+
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts, ok := spec.(*ast.TypeSpec)
+			if !ok || !ts.Name.IsExported() {
+				continue
+			}
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				continue
+			}
+
+			target := targetStruct{Name: ts.Name.Name}
+			for _, field := range st.Fields.List {
+				writer, encodeExprFmt, decode, ok := fieldCodecForType(field.Type)
+				if !ok {
+					continue
+				}
+				for _, name := range field.Names {
+					if name.IsExported() {
+						target.Fields = append(target.Fields, structField{
+							Name:       name.Name,
+							Writer:     writer,
+							EncodeExpr: fmt.Sprintf(encodeExprFmt, name.Name),
+							Decode:     decode,
+						})
+					}
+				}
+			}
+			if len(target.Fields) > 0 {
+				out = append(out, target)
+			}
+		}
+	}
+
+	return out
+}
+
+// fieldCodecForType maps a supported Go field type to: the schema.Write*
+// helper that encodes it; a %s-style format string (filled in with the
+// field name) giving the Go expression passed to that helper; and a Go
+// expression of the form "decoded, ok" that type-asserts a decoded JSON
+// value (raw) into the field's type. JSON numbers decode as float64, so
+// both int-ish and float-ish fields assert against float64.
+func fieldCodecForType(expr ast.Expr) (writer string, encodeExprFmt string, decode string, ok bool) {
+	ident, isIdent := expr.(*ast.Ident)
+	if !isIdent {
+		return "", "", "", false
+	}
+	switch ident.Name {
+	case "string":
+		return "WriteString", "v.%s", `raw.(string)`, true
+	case "int":
+		return "WriteInt64", "int64(v.%s)", `func() (int, bool) { f, ok := raw.(float64); return int(f), ok }()`, true
+	case "int64":
+		return "WriteInt64", "v.%s", `func() (int64, bool) { f, ok := raw.(float64); return int64(f), ok }()`, true
+	case "float64":
+		return "WriteFloat64", "v.%s", `raw.(float64)`, true
+	case "bool":
+		return "WriteBool", "v.%s", `raw.(bool)`, true
+	default:
+		return "", "", "", false
+	}
+}
+
+func FileExists(name string) bool {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	if fi.IsDir() {
+		return false
+	}
+	return true
+}
+
+var genTemplate = template.Must(template.New("gen").Parse(`// Code generated by json2msgpack-gen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"io"
+
+	"github.com/glycerine/json2msgpack/schema"
+)
+
+// EncodeMsg writes v's msgpack encoding directly to w, without
+// reflection.
+func (v *{{.Struct.Name}}) EncodeMsg(w io.Writer) error {
+	if err := schema.WriteMapHeader(w, {{len .Struct.Fields}}); err != nil {
+		return err
+	}
+{{range .Struct.Fields}}	if err := schema.WriteString(w, "{{.Name}}"); err != nil {
+		return err
+	}
+	if err := schema.{{.Writer}}(w, {{.EncodeExpr}}); err != nil {
+		return err
+	}
+{{end}}	return nil
+}
+
+// New builds a {{.Struct.Name}} from record, field by field, and returns
+// it as a schema.Encoder. It is the symbol schema.Load looks up in the
+// compiled plugin.
+func New(record map[string]interface{}) (schema.Encoder, error) {
+	v := &{{.Struct.Name}}{}
+{{range .Struct.Fields}}	if raw, ok := record["{{.Name}}"]; ok {
+		if typed, ok := {{.Decode}}; ok {
+			v.{{.Name}} = typed
+		}
+	}
+{{end}}	return v, nil
+}
+`))
@@ -11,8 +11,6 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/binary"
 	"flag"
 	"fmt"
 	"io"
@@ -20,7 +18,11 @@ import (
 	"os"
 	"path"
 	"reflect"
+	"runtime"
+	"time"
 
+	"github.com/glycerine/json2msgpack/framing"
+	"github.com/glycerine/json2msgpack/schema"
 	"github.com/ugorji/go/codec"
 )
 
@@ -33,12 +35,65 @@ type JsonMsgpConfig struct {
 	OutputPath string
 	Input      *os.File
 	Output     *os.File
+
+	// OutputMode selects how converted records are emitted: "framed"
+	// (default) writes length-prefixed msgpack frames to Output; "fluentd"
+	// forwards each record to FluentdAddress using the Fluentd Forward
+	// protocol instead.
+	OutputMode string
+
+	// Tag, TimestampField, FluentdAddress, BatchSize, and BatchInterval
+	// only apply when OutputMode is "fluentd".
+	Tag            string
+	TimestampField string
+	FluentdAddress string
+	BatchSize      int
+	BatchInterval  time.Duration
+
+	// Compress names the codec used to compress each frame's payload
+	// ("raw", "snappy", "zstd", or "gzip"); only applies when OutputMode
+	// is "framed".
+	Compress string
+	codec    framing.Codec
+
+	// Workers is the number of goroutines that decode+encode+frame
+	// records concurrently; only applies when OutputMode is "framed".
+	Workers int
+
+	// Schema, when set, points at a .go file declaring a struct for which
+	// json2msgpack-gen has already generated a typed encoder (its
+	// <base>_gen.go in the same directory), which schema.Load compiles at
+	// startup; records are then encoded through it instead of through
+	// reflection-based codec.Encoder. Only applies when OutputMode is
+	// "framed".
+	Schema string
+
+	// Index, when set, writes a .idx sidecar recording the byte offset
+	// and size of every frame, so tools like msgpackParseBench can seek
+	// directly to frame N instead of scanning from the start. Requires
+	// -output to name a real (seekable) file; only applies when
+	// OutputMode is "framed".
+	Index string
+
+	fw        *framing.FrameWriter
+	forwarder *FluentdForwarder
+	schemaNew schema.NewFunc
 }
 
 // call DefineFlags before myflags.Parse()
 func (c *JsonMsgpConfig) DefineFlags(fs *flag.FlagSet) {
 	fs.StringVar(&c.InputPath, "input", "", "path to read from (stdin default)")
 	fs.StringVar(&c.OutputPath, "output", "", "path to write to (stdout default)")
+	fs.StringVar(&c.OutputMode, "output-mode", "framed", "how to emit records: 'framed' (length-prefixed msgpack to -output) or 'fluentd' (Fluentd Forward protocol to -fluentd-address)")
+	fs.StringVar(&c.Tag, "tag", defaultFluentdTag(), "Fluentd tag to forward records under (output-mode=fluentd only)")
+	fs.StringVar(&c.TimestampField, "timestamp-field", "", "JSON field to use as the Fluentd event timestamp; defaults to time.Now().Unix() if unset (output-mode=fluentd only)")
+	fs.StringVar(&c.FluentdAddress, "fluentd-address", "", "host:port of the Fluentd/Fluent Bit collector (required for output-mode=fluentd)")
+	fs.IntVar(&c.BatchSize, "batch", 0, "batch up to this many records per Fluentd Forward message before flushing (output-mode=fluentd only; 0 disables batching)")
+	fs.DurationVar(&c.BatchInterval, "batch-interval", 0, "flush a partial Fluentd batch when a record arrives this long after the last flush, even if -batch records haven't accumulated yet (output-mode=fluentd only)")
+	fs.StringVar(&c.Compress, "compress", "raw", "compress each frame's payload with 'raw', 'snappy', 'zstd', or 'gzip' (output-mode=framed only)")
+	fs.IntVar(&c.Workers, "workers", runtime.NumCPU(), "number of goroutines decoding/encoding/framing records concurrently (output-mode=framed only)")
+	fs.StringVar(&c.Schema, "schema", "", "path to a .go file declaring a struct to encode records through, bypassing reflection (output-mode=framed only)")
+	fs.StringVar(&c.Index, "index", "", "write a .idx sidecar recording each frame's byte offset and size, for random access (output-mode=framed only, requires -output to name a file)")
 }
 
 // call c.ValidateConfig() after myflags.Parse()
@@ -59,17 +114,55 @@ func (c *JsonMsgpConfig) ValidateConfig() error {
 		c.InputPath = "(stdin)"
 	}
 
-	if c.OutputPath != "" {
-		if FileExists(c.OutputPath) {
-			return fmt.Errorf("-output path '%s' already exists (delete/move it away it first)", c.OutputPath)
+	c.codec, err = framing.ParseCodec(c.Compress)
+	if err != nil {
+		return err
+	}
+
+	if c.Workers < 1 {
+		c.Workers = 1
+	}
+
+	if c.Schema != "" {
+		if !FileExists(c.Schema) {
+			return fmt.Errorf("-schema path '%s' does not exist", c.Schema)
 		}
-		c.Output, err = os.Create(c.OutputPath)
+		c.schemaNew, err = schema.Load(c.Schema)
 		if err != nil {
 			return err
 		}
-	} else {
-		c.Output = os.Stdout
-		c.OutputPath = "(stdout)"
+	}
+
+	if c.Index != "" && c.OutputMode != "framed" {
+		return fmt.Errorf("-index requires -output-mode=framed")
+	}
+
+	switch c.OutputMode {
+	case "framed":
+		if c.OutputPath != "" {
+			if FileExists(c.OutputPath) {
+				return fmt.Errorf("-output path '%s' already exists (delete/move it away it first)", c.OutputPath)
+			}
+			c.Output, err = os.Create(c.OutputPath)
+			if err != nil {
+				return err
+			}
+		} else {
+			if c.Index != "" {
+				return fmt.Errorf("-index requires -output to name a file, not stdout")
+			}
+			c.Output = os.Stdout
+			c.OutputPath = "(stdout)"
+		}
+
+	case "fluentd":
+		if c.FluentdAddress == "" {
+			return fmt.Errorf("-fluentd-address is required when -output-mode=fluentd")
+		}
+		c.forwarder = NewFluentdForwarder(c.FluentdAddress, c.Tag, c.BatchSize, c.BatchInterval)
+
+	default:
+		return fmt.Errorf("-output-mode '%s' is not recognized; use 'framed' or 'fluentd'", c.OutputMode)
 	}
 
 	return nil
@@ -88,21 +181,68 @@ func main() {
 		log.Fatalf("%s error: '%s'", ProgramName, err)
 	}
 
+	status := processFile(cfg)
+	if status == 0 && cfg.Index != "" {
+		status = buildIndexFile(cfg)
+	}
+
+	// Close (and, for forwarder, flush) explicitly rather than via defer:
+	// os.Exit below never runs deferred functions, so a deferred
+	// forwarder.Close would silently drop a partial batch that never hit
+	// -batch's threshold.
 	if cfg.InputPath != "" {
-		defer cfg.Input.Close()
+		cfg.Input.Close()
 	}
-	if cfg.OutputPath != "" {
-		defer cfg.Output.Close()
+	if cfg.OutputMode == "framed" && cfg.OutputPath != "" {
+		cfg.Output.Close()
+	}
+	if cfg.forwarder != nil {
+		if err := cfg.forwarder.Close(); err != nil && status == 0 {
+			printError(err)
+			status = 2
+		}
 	}
 
-	status := processFile(cfg)
 	os.Exit(status)
 }
 
+// buildIndexFile re-scans cfg.Output, which processFile has just
+// finished writing, to record every frame's offset and size, and writes
+// the result to cfg.Index as a .idx sidecar.
+func buildIndexFile(cfg *JsonMsgpConfig) int {
+	idx, err := framing.BuildIndex(cfg.Output)
+	if err != nil {
+		printError(fmt.Errorf("building index for '%s': %s", cfg.OutputPath, err))
+		return 2
+	}
+
+	idxFile, err := os.Create(cfg.Index)
+	if err != nil {
+		printError(err)
+		return 2
+	}
+	defer idxFile.Close()
+
+	if err := framing.WriteIndex(idxFile, idx); err != nil {
+		printError(fmt.Errorf("writing index '%s': %s", cfg.Index, err))
+		return 2
+	}
+
+	return 0
+}
+
 func processFile(cfg *JsonMsgpConfig) int {
+	if cfg.OutputMode == "fluentd" {
+		return processFluentd(cfg)
+	}
+	return processFramedPipeline(cfg)
+}
+
+// processFluentd is the sequential, one-line-at-a-time path used for
+// output-mode=fluentd, where records are forwarded (and possibly batched)
+// over a single net.Conn rather than written to a file.
+func processFluentd(cfg *JsonMsgpConfig) int {
 	bufIn := bufio.NewReader(cfg.Input)
-	arr := make([]byte, 0, 1024*1024)
-	buf := bytes.NewBuffer(arr)
 
 	lineNum := int64(1)
 	for {
@@ -116,11 +256,9 @@ func processFile(cfg *JsonMsgpConfig) int {
 			break
 		}
 
-		status := jsonToMsgp(cfg, buf, lastLine, lineNum)
-		if status > 0 {
+		if status := jsonToFluentd(cfg, lastLine, lineNum); status > 0 {
 			return status
 		}
-		buf.Reset()
 		lineNum += 1
 
 		if err == io.EOF {
@@ -131,50 +269,37 @@ func processFile(cfg *JsonMsgpConfig) int {
 	return 0
 }
 
-// one (once upon a time newline delimited) line in js should have a complete JSON object.
-func jsonToMsgp(cfg *JsonMsgpConfig, buf *bytes.Buffer, js []byte, lineNum int64) int {
+// jsonToFluentd decodes one line of input JSON into a map and forwards it
+// to cfg.forwarder as a Fluentd event, pulling the event timestamp from
+// cfg.TimestampField when set and falling back to time.Now().Unix().
+func jsonToFluentd(cfg *JsonMsgpConfig, js []byte, lineNum int64) int {
 
-	// js contains the bytes to decode from
-	var jh codec.Handle = new(codec.JsonHandle)
+	jh := new(codec.JsonHandle)
+	jh.MapType = reflect.TypeOf(map[string]interface{}(nil))
 	var dec *codec.Decoder = codec.NewDecoderBytes(js, jh)
-	var iface interface{}
-	var err error = dec.Decode(&iface)
+	var record map[string]interface{}
+	err := dec.Decode(&record)
 	if err != nil {
 		panic(fmt.Errorf("at line %d of input '%s', Decode error: '%s'", lineNum, cfg.InputPath, err))
 	}
 
-	//fmt.Printf("debug: iface = %#v\n", iface)
-
-	var mh codec.MsgpackHandle
-
-	mh.MapType = reflect.TypeOf(map[string]interface{}(nil))
-
-	// configure extensions
-	// e.g. for msgpack, define functions and enable Time support for tag 1
-	//mh.SetExt(reflect.TypeOf(time.Time{}), 1, myExt)
-
-	enc := codec.NewEncoder(buf, &mh)
-	err = enc.Encode(iface)
-	if err != nil {
-		panic(fmt.Errorf("at line %d of input '%s', Encoding error trying to encode iface='%#v': '%s'", lineNum, cfg.InputPath, iface, err))
-	}
-
-	//fmt.Printf("encoded into buf %d bytes\n", buf.Len())
-
-	blen := buf.Len()
-	if blen > 4294967295 {
-		panic(fmt.Errorf("json message at line %d of '%s' is too long at %d bytes", lineNum, cfg.InputPath, blen))
-	}
-
-	// frame the output with a 2-5 byte header
-	err = writeMsgpackBinArrayHeader(cfg.Output, uint32(blen))
-	if err != nil {
-		panic(fmt.Errorf("at line %d of input '%s', call to writeMsgpackBinArrayHeader(output='%s', blen=%d) produced error: '%s'", lineNum, cfg.InputPath, cfg.OutputPath, blen, err))
+	ts := time.Now().Unix()
+	if cfg.TimestampField != "" {
+		if v, ok := record[cfg.TimestampField]; ok {
+			switch n := v.(type) {
+			case int64:
+				ts = n
+			case float64:
+				ts = int64(n)
+			default:
+				panic(fmt.Errorf("at line %d of input '%s', -timestamp-field '%s' has non-numeric value '%#v'", lineNum, cfg.InputPath, cfg.TimestampField, v))
+			}
+		}
 	}
 
-	_, err = io.Copy(cfg.Output, buf)
+	err = cfg.forwarder.Send(ts, record)
 	if err != nil {
-		panic(fmt.Errorf("at line %d of input '%s', copying to output '%s' produced error: '%s'", lineNum, cfg.InputPath, cfg.OutputPath, err))
+		panic(fmt.Errorf("at line %d of input '%s', forwarding to fluentd '%s' produced error: '%s'", lineNum, cfg.InputPath, cfg.FluentdAddress, err))
 	}
 
 	return 0
@@ -191,26 +316,6 @@ func panicOn(err error) {
 	}
 }
 
-func writeMsgpackBinArrayHeader(w io.Writer, l uint32) error {
-	var by [8]byte
-	var nBytesAdded int
-	if l < 256 {
-		by[0] = 0xc4 // msgpackBin8
-		by[1] = uint8(l)
-		nBytesAdded = 2
-	} else if l < 65536 {
-		by[0] = 0xc5 // msgpackBin16
-		binary.BigEndian.PutUint16(by[1:3], uint16(l))
-		nBytesAdded = 3
-	} else {
-		by[0] = 0xc6 // msgpackBin32
-		binary.BigEndian.PutUint32(by[1:5], l)
-		nBytesAdded = 5
-	}
-	_, err := w.Write(by[:nBytesAdded])
-	return err
-}
-
 func FileExists(name string) bool {
 	fi, err := os.Stat(name)
 	if err != nil {
@@ -6,14 +6,16 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path"
+	"reflect"
+	"time"
 
+	"github.com/glycerine/json2msgpack/schema"
 	"github.com/ugorji/go/codec"
 )
 
@@ -22,11 +24,19 @@ var ProgramName string = path.Base(os.Args[0])
 type JsonBench struct {
 	InputPath string
 	Input     *os.File
+
+	// Schema, when set, benchmarks the schema-driven encoder generated
+	// from that file instead of the default reflected codec.Encoder
+	// path, so the two ns/op figures can be compared against each other
+	// by running jsonParseBench once with -schema and once without.
+	Schema    string
+	schemaNew schema.NewFunc
 }
 
 // call DefineFlags before myflags.Parse()
 func (c *JsonBench) DefineFlags(fs *flag.FlagSet) {
 	fs.StringVar(&c.InputPath, "input", "", "path to read from (stdin default)")
+	fs.StringVar(&c.Schema, "schema", "", "path to a .go file declaring a struct to encode records through, bypassing reflection (compares against the reflected baseline)")
 }
 
 // call c.ValidateConfig() after myflags.Parse()
@@ -47,6 +57,16 @@ func (c *JsonBench) ValidateConfig() error {
 		c.InputPath = "(stdin)"
 	}
 
+	if c.Schema != "" {
+		if !FileExists(c.Schema) {
+			return fmt.Errorf("-schema path '%s' does not exist", c.Schema)
+		}
+		c.schemaNew, err = schema.Load(c.Schema)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -76,6 +96,10 @@ func processFile(cfg *JsonBench) int {
 	arr := make([]byte, 0, 1024*1024)
 	buf := bytes.NewBuffer(arr)
 
+	var mh codec.MsgpackHandle
+	mh.MapType = reflect.TypeOf(map[string]interface{}(nil))
+
+	start := time.Now()
 	lineNum := int64(1)
 	for {
 		lastLine, err := bufIn.ReadBytes('\n')
@@ -88,7 +112,12 @@ func processFile(cfg *JsonBench) int {
 			break
 		}
 
-		status := jsonDecode(cfg, buf, lastLine, lineNum)
+		var status int
+		if cfg.schemaNew != nil {
+			status = jsonToMsgpViaSchema(cfg, buf, lastLine, lineNum)
+		} else {
+			status = jsonToMsgpReflected(cfg, &mh, buf, lastLine, lineNum)
+		}
 		if status > 0 {
 			return status
 		}
@@ -98,24 +127,60 @@ func processFile(cfg *JsonBench) int {
 		}
 		lineNum += 1
 	}
-
-	fmt.Printf("parsed %d lines of json\n", lineNum-1)
+	elapsed := time.Since(start)
+
+	n := lineNum - 1
+	fmt.Printf("parsed and re-encoded %d lines of json\n", n)
+	if n > 0 {
+		label := "reflected baseline"
+		if cfg.schemaNew != nil {
+			label = "schema-driven"
+		}
+		fmt.Printf("%d ns/op (%s)\n", elapsed.Nanoseconds()/n, label)
+	}
 	return 0
 }
 
-// one (once upon a time newline delimited) line in js should have a complete JSON object.
-func jsonDecode(cfg *JsonBench, buf *bytes.Buffer, js []byte, lineNum int64) int {
-
-	// js contains the bytes to decode from
+// jsonToMsgpReflected decodes one line of JSON into interface{} and
+// re-encodes it as msgpack via codec's reflection-based encoder; this is
+// the same work pipeline.go's encodeLineReflected does, so its ns/op is
+// directly comparable to jsonToMsgpViaSchema's.
+func jsonToMsgpReflected(cfg *JsonBench, mh *codec.MsgpackHandle, buf *bytes.Buffer, js []byte, lineNum int64) int {
 	var jh codec.Handle = new(codec.JsonHandle)
-	var dec *codec.Decoder = codec.NewDecoderBytes(js, jh)
+	dec := codec.NewDecoderBytes(js, jh)
 	var iface interface{}
-	var err error = dec.Decode(&iface)
-	if err != nil {
+	if err := dec.Decode(&iface); err != nil {
+		panic(fmt.Errorf("at line %d of input '%s', Decode error: '%s'", lineNum, cfg.InputPath, err))
+	}
+
+	enc := codec.NewEncoder(buf, mh)
+	if err := enc.Encode(iface); err != nil {
+		panic(fmt.Errorf("at line %d of input '%s', Encode error: '%s'", lineNum, cfg.InputPath, err))
+	}
+	return 0
+}
+
+// jsonToMsgpViaSchema decodes one line of JSON into a map and hands it to
+// cfg.schemaNew, which builds the schema's target struct and returns it
+// as a schema.Encoder; this is the same work pipeline.go's
+// encodeLineViaSchema does, so its ns/op is directly comparable to
+// jsonToMsgpReflected's.
+func jsonToMsgpViaSchema(cfg *JsonBench, buf *bytes.Buffer, js []byte, lineNum int64) int {
+	jh := new(codec.JsonHandle)
+	jh.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	dec := codec.NewDecoderBytes(js, jh)
+	var record map[string]interface{}
+	if err := dec.Decode(&record); err != nil {
 		panic(fmt.Errorf("at line %d of input '%s', Decode error: '%s'", lineNum, cfg.InputPath, err))
 	}
 
-	//fmt.Printf("debug: iface = %#v\n", iface)
+	enc, err := cfg.schemaNew(record)
+	if err != nil {
+		panic(fmt.Errorf("at line %d of input '%s', schema error building encoder: '%s'", lineNum, cfg.InputPath, err))
+	}
+	if err := enc.EncodeMsg(buf); err != nil {
+		panic(fmt.Errorf("at line %d of input '%s', schema EncodeMsg error: '%s'", lineNum, cfg.InputPath, err))
+	}
 	return 0
 }
 
@@ -130,26 +195,6 @@ func panicOn(err error) {
 	}
 }
 
-func writeMsgpackBinArrayHeader(w io.Writer, l uint32) error {
-	var by [8]byte
-	var nBytesAdded int
-	if l < 256 {
-		by[0] = 0xc4 // msgpackBin8
-		by[1] = uint8(l)
-		nBytesAdded = 2
-	} else if l < 65536 {
-		by[0] = 0xc5 // msgpackBin16
-		binary.BigEndian.PutUint16(by[1:3], uint16(l))
-		nBytesAdded = 3
-	} else {
-		by[0] = 0xc6 // msgpackBin32
-		binary.BigEndian.PutUint32(by[1:5], l)
-		nBytesAdded = 5
-	}
-	_, err := w.Write(by[:nBytesAdded])
-	return err
-}
-
 func FileExists(name string) bool {
 	fi, err := os.Stat(name)
 	if err != nil {
@@ -171,34 +216,3 @@ func DirExists(name string) bool {
 	}
 	return false
 }
-
-func DecodeMsgpackBinArrayHeader(p []byte) (headerSize int, payloadSize int, totalFrameSize int, err error) {
-	lenp := len(p)
-
-	switch p[0] {
-	case 0xc4: // msgpackBin8
-		if lenp < 2 {
-			err = fmt.Errorf("DecodeMsgpackBinArrayHeader error: p len (%d) too small", lenp)
-			return
-		}
-		headerSize = 2
-		payloadSize = int(p[1])
-	case 0xc5: // msgpackBin16
-		if lenp < 3 {
-			err = fmt.Errorf("DecodeMsgpackBinArrayHeader error: p len (%d) too small", lenp)
-			return
-		}
-		headerSize = 3
-		payloadSize = int(binary.BigEndian.Uint16(p[1:3]))
-	case 0xc6: // msgpackBin32
-		if lenp < 5 {
-			err = fmt.Errorf("DecodeMsgpackBinArrayHeader error: p len (%d) too small", lenp)
-			return
-		}
-		headerSize = 5
-		payloadSize = int(binary.BigEndian.Uint32(p[1:5]))
-	}
-
-	totalFrameSize = headerSize + payloadSize
-	return
-}
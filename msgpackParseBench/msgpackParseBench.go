@@ -4,8 +4,7 @@ msgpackParseBench.go: measure speed of msgpack ingest by go and ugorji/go/codec
 package main
 
 import (
-	"bufio"
-	"encoding/binary"
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
@@ -13,7 +12,10 @@ import (
 	"os"
 	"path"
 	"reflect"
+	"time"
 
+	"github.com/glycerine/json2msgpack/framing"
+	"github.com/glycerine/json2msgpack/schema"
 	"github.com/ugorji/go/codec"
 )
 
@@ -53,11 +55,31 @@ var ProgramName string = path.Base(os.Args[0])
 type MsgpBench struct {
 	InputPath string
 	Input     *os.File
+
+	// IndexPath names the .idx sidecar to load for -seek; defaults to
+	// InputPath+".idx".
+	IndexPath string
+
+	// Seek, when >= 0, skips straight to frame number Seek (0-based)
+	// using the index instead of scanning every frame from the start.
+	Seek int
+
+	// Schema, when set, decodes each frame into a map with the
+	// reflection-based codec.Decoder and then re-encodes it through the
+	// schema-driven encoder generated from that file. Without it, each
+	// frame is only decoded by codec.Decoder, with no re-encoding, so the
+	// -schema ns/op figure also includes an encode step the baseline
+	// does not.
+	Schema    string
+	schemaNew schema.NewFunc
 }
 
 // call DefineFlags before myflags.Parse()
 func (c *MsgpBench) DefineFlags(fs *flag.FlagSet) {
 	fs.StringVar(&c.InputPath, "input", "", "path to read from (stdin default)")
+	fs.StringVar(&c.IndexPath, "index", "", "path to the .idx sidecar to use with -seek (defaults to <input>.idx)")
+	fs.IntVar(&c.Seek, "seek", -1, "jump directly to this 0-based frame number via the .idx sidecar, instead of scanning from the start")
+	fs.StringVar(&c.Schema, "schema", "", "path to a .go file declaring a struct to re-encode each decoded record through, bypassing reflection for the encode step (the default path only decodes)")
 }
 
 // call c.ValidateConfig() after myflags.Parse()
@@ -74,10 +96,27 @@ func (c *MsgpBench) ValidateConfig() error {
 			return err
 		}
 	} else {
+		if c.Seek >= 0 {
+			return fmt.Errorf("-seek requires -input to name a seekable file, not stdin")
+		}
 		c.Input = os.Stdin
 		c.InputPath = "(stdin)"
 	}
 
+	if c.Seek >= 0 && c.IndexPath == "" {
+		c.IndexPath = c.InputPath + ".idx"
+	}
+
+	if c.Schema != "" {
+		if !FileExists(c.Schema) {
+			return fmt.Errorf("-schema path '%s' does not exist", c.Schema)
+		}
+		c.schemaNew, err = schema.Load(c.Schema)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -103,42 +142,126 @@ func main() {
 }
 
 func processFile(cfg *MsgpBench) int {
+	if cfg.Seek >= 0 {
+		return seekFrame(cfg)
+	}
 
 	h.init()
-	var r interface{}
-	var s interface{}
 
-	bufIn := bufio.NewReader(cfg.Input)
-	decoder := codec.NewDecoder(bufIn, &h.mh)
+	fr := framing.NewFrameReader(cfg.Input)
+	arr := make([]byte, 0, 1024*1024)
+	buf := bytes.NewBuffer(arr)
 
+	start := time.Now()
 	k := 0
-	var err error
 	for {
-		err = decoder.Decode(&r)
+		payload, err := fr.Next()
 		if err != nil {
 			break
 		}
-		switch val := r.(type) {
-		case []byte:
-			//fmt.Printf("got a []byte\n")
-			headerSz, _, _, err := DecodeMsgpackBinArrayHeader(val[:])
-			if err != nil {
+
+		if cfg.schemaNew != nil {
+			if err := decodeMsgpViaSchema(cfg, buf, payload); err != nil {
 				break
 			}
-
-			decodeSlice := codec.NewDecoderBytes(val[headerSz:], &h.mh)
-			err = decodeSlice.Decode(&s)
-			if err != nil {
+			buf.Reset()
+		} else {
+			var s interface{}
+			decodeSlice := codec.NewDecoderBytes(payload, &h.mh)
+			if err := decodeSlice.Decode(&s); err != nil {
 				break
 			}
-			//fmt.Printf("decoded a []byte into: '%#v'\n", s)
-			k++
-		default:
-			panic(fmt.Sprintf("unexpected %T with val = '%#v'", val, val))
+			//fmt.Printf("decoded a frame into: '%#v'\n", s)
 		}
+		k++
 	}
+	elapsed := time.Since(start)
 
 	fmt.Printf("parsed a total of %d msgpack frames.\n", k)
+	if k > 0 {
+		label := "reflected baseline"
+		if cfg.schemaNew != nil {
+			label = "schema-driven"
+		}
+		fmt.Printf("%d ns/op (%s)\n", elapsed.Nanoseconds()/int64(k), label)
+	}
+	return 0
+}
+
+// decodeMsgpViaSchema decodes one msgpack frame's payload into a map and
+// hands it to cfg.schemaNew, which builds the schema's target struct and
+// returns it as a schema.Encoder, then re-encodes it through EncodeMsg.
+// It mirrors pipeline.go's encodeLineViaSchema, except that its input is
+// msgpack rather than JSON; unlike the reflected baseline, which only
+// decodes, it also encodes each record.
+func decodeMsgpViaSchema(cfg *MsgpBench, buf *bytes.Buffer, payload []byte) error {
+	decodeSlice := codec.NewDecoderBytes(payload, &h.mh)
+	var record map[string]interface{}
+	if err := decodeSlice.Decode(&record); err != nil {
+		return err
+	}
+
+	enc, err := cfg.schemaNew(record)
+	if err != nil {
+		return err
+	}
+	return enc.EncodeMsg(buf)
+}
+
+// seekFrame loads cfg.IndexPath and uses it to jump straight to frame
+// cfg.Seek, instead of scanning every frame before it, then decodes just
+// that one frame and reports how long the seek-and-decode took.
+func seekFrame(cfg *MsgpBench) int {
+	h.init()
+
+	idxFile, err := os.Open(cfg.IndexPath)
+	if err != nil {
+		printError(fmt.Errorf("opening index '%s': %s", cfg.IndexPath, err))
+		return 2
+	}
+	defer idxFile.Close()
+
+	idx, err := framing.ReadIndex(idxFile)
+	if err != nil {
+		printError(fmt.Errorf("reading index '%s': %s", cfg.IndexPath, err))
+		return 2
+	}
+
+	if cfg.Seek >= idx.FrameCount() {
+		printError(fmt.Errorf("-seek=%d is out of range; index has %d frame(s)", cfg.Seek, idx.FrameCount()))
+		return 2
+	}
+
+	compressed, err := framing.DetectCompressed(cfg.Input)
+	if err != nil {
+		printError(err)
+		return 2
+	}
+
+	start := time.Now()
+
+	offset, _ := idx.FrameAt(cfg.Seek)
+	if _, err := cfg.Input.Seek(offset, io.SeekStart); err != nil {
+		printError(err)
+		return 2
+	}
+
+	fr := framing.NewFrameReaderAt(cfg.Input, compressed)
+	payload, err := fr.Next()
+	if err != nil {
+		printError(fmt.Errorf("reading frame %d at offset %d: %s", cfg.Seek, offset, err))
+		return 2
+	}
+
+	var s interface{}
+	decodeSlice := codec.NewDecoderBytes(payload, &h.mh)
+	if err := decodeSlice.Decode(&s); err != nil {
+		printError(fmt.Errorf("decoding frame %d: %s", cfg.Seek, err))
+		return 2
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf("seeked directly to frame %d and decoded it in %d ns/op\n", cfg.Seek, elapsed.Nanoseconds())
 	return 0
 }
 
@@ -153,26 +276,6 @@ func panicOn(err error) {
 	}
 }
 
-func writeMsgpackBinArrayHeader(w io.Writer, l uint32) error {
-	var by [8]byte
-	var nBytesAdded int
-	if l < 256 {
-		by[0] = 0xc4 // msgpackBin8
-		by[1] = uint8(l)
-		nBytesAdded = 2
-	} else if l < 65536 {
-		by[0] = 0xc5 // msgpackBin16
-		binary.BigEndian.PutUint16(by[1:3], uint16(l))
-		nBytesAdded = 3
-	} else {
-		by[0] = 0xc6 // msgpackBin32
-		binary.BigEndian.PutUint32(by[1:5], l)
-		nBytesAdded = 5
-	}
-	_, err := w.Write(by[:nBytesAdded])
-	return err
-}
-
 func FileExists(name string) bool {
 	fi, err := os.Stat(name)
 	if err != nil {
@@ -194,34 +297,3 @@ func DirExists(name string) bool {
 	}
 	return false
 }
-
-func DecodeMsgpackBinArrayHeader(p []byte) (headerSize int, payloadSize int, totalFrameSize int, err error) {
-	lenp := len(p)
-
-	switch p[0] {
-	case 0xc4: // msgpackBin8
-		if lenp < 2 {
-			err = fmt.Errorf("DecodeMsgpackBinArrayHeader error: p len (%d) too small", lenp)
-			return
-		}
-		headerSize = 2
-		payloadSize = int(p[1])
-	case 0xc5: // msgpackBin16
-		if lenp < 3 {
-			err = fmt.Errorf("DecodeMsgpackBinArrayHeader error: p len (%d) too small", lenp)
-			return
-		}
-		headerSize = 3
-		payloadSize = int(binary.BigEndian.Uint16(p[1:3]))
-	case 0xc6: // msgpackBin32
-		if lenp < 5 {
-			err = fmt.Errorf("DecodeMsgpackBinArrayHeader error: p len (%d) too small", lenp)
-			return
-		}
-		headerSize = 5
-		payloadSize = int(binary.BigEndian.Uint32(p[1:5]))
-	}
-
-	totalFrameSize = headerSize + payloadSize
-	return
-}
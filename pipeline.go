@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/glycerine/json2msgpack/framing"
+	"github.com/ugorji/go/codec"
+)
+
+// lineItem is one line of input JSON, numbered so the writer can restore
+// input order after cfg.Workers goroutines process lines concurrently.
+type lineItem struct {
+	lineNum int64
+	line    []byte
+}
+
+// frameItem is the fully encoded frame (header plus payload) produced
+// for one lineItem.
+type frameItem struct {
+	lineNum int64
+	frame   []byte
+}
+
+// processFramedPipeline converts cfg.Input to framed msgpack on
+// cfg.Output using a producer/worker-pool/writer pipeline: one goroutine
+// reads newline-delimited JSON into numbered lineItems, cfg.Workers
+// goroutines each own their own codec.Decoder/Encoder and turn a lineItem
+// into a frameItem independently, and a single writer goroutine
+// reassembles frameItems in line order before writing them to cfg.Output.
+// The channels between stages are bounded, so a slow writer (or disk)
+// applies backpressure all the way back to the reader instead of
+// buffering the whole input in memory. The first reported error closes
+// stop, which tells produceLines to stop reading further input; without
+// that, a single bad line early in a large file would otherwise let the
+// producer keep reading (and encodeLines keep encoding and buffering)
+// the entire remainder of the input into the writer's reorder buffer
+// before the pipeline finally gave up.
+func processFramedPipeline(cfg *JsonMsgpConfig) int {
+	var err error
+	cfg.fw, err = framing.NewCompressedFrameWriter(cfg.Output, cfg.codec)
+	if err != nil {
+		printError(err)
+		return 2
+	}
+
+	queueDepth := cfg.Workers * 4
+	lines := make(chan lineItem, queueDepth)
+	frames := make(chan frameItem, queueDepth)
+	errs := make(chan error, 1)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+
+	reportErr := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+		stopOnce.Do(func() { close(stop) })
+	}
+
+	start := time.Now()
+	go produceLines(cfg, lines, stop, reportErr)
+
+	var workers sync.WaitGroup
+	workers.Add(cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go func() {
+			defer workers.Done()
+			encodeLines(cfg, lines, frames, reportErr)
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(frames)
+	}()
+
+	n, err := writeFramesInOrder(cfg, frames)
+	if err != nil {
+		reportErr(err)
+	}
+	elapsed := time.Since(start)
+
+	select {
+	case err := <-errs:
+		printError(err)
+		return 2
+	default:
+		if n > 0 && elapsed > 0 {
+			fmt.Fprintf(os.Stderr, "processed %d lines in %s using %d worker(s) (%.0f lines/sec)\n", n, elapsed, cfg.Workers, float64(n)/elapsed.Seconds())
+		}
+		return 0
+	}
+}
+
+// produceLines reads cfg.Input line by line and sends numbered lineItems
+// to out, closing out once the input is exhausted or stop is closed.
+func produceLines(cfg *JsonMsgpConfig, out chan<- lineItem, stop <-chan struct{}, reportErr func(error)) {
+	defer close(out)
+
+	bufIn := bufio.NewReader(cfg.Input)
+	lineNum := int64(1)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		line, err := bufIn.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			reportErr(fmt.Errorf("reading input '%s': %s", cfg.InputPath, err))
+			return
+		}
+
+		if err == io.EOF && len(line) == 0 {
+			return
+		}
+
+		select {
+		case out <- lineItem{lineNum: lineNum, line: line}:
+		case <-stop:
+			return
+		}
+		lineNum++
+
+		if err == io.EOF {
+			return
+		}
+	}
+}
+
+// encodeLines decodes each incoming lineItem's JSON, re-encodes it as
+// msgpack, frames it, and sends the result on out. Each call owns its
+// own codec.MsgpackHandle so concurrent callers never share encoder
+// state. When cfg.schemaNew is set, encoding goes through the generated,
+// reflection-free schema.Encoder instead of codec's reflection-based
+// encoder.
+func encodeLines(cfg *JsonMsgpConfig, in <-chan lineItem, out chan<- frameItem, reportErr func(error)) {
+	var mh codec.MsgpackHandle
+	mh.MapType = reflect.TypeOf(map[string]interface{}(nil))
+
+	for item := range in {
+		var buf bytes.Buffer
+		var err error
+		if cfg.schemaNew != nil {
+			err = encodeLineViaSchema(cfg, &buf, item.line)
+		} else {
+			err = encodeLineReflected(&mh, &buf, item.line)
+		}
+		if err != nil {
+			reportErr(fmt.Errorf("at line %d of input '%s': %s", item.lineNum, cfg.InputPath, err))
+			continue
+		}
+
+		frame, err := cfg.fw.EncodeFrame(buf.Bytes())
+		if err != nil {
+			reportErr(fmt.Errorf("at line %d of input '%s', framing error: '%s'", item.lineNum, cfg.InputPath, err))
+			continue
+		}
+
+		out <- frameItem{lineNum: item.lineNum, frame: frame}
+	}
+}
+
+// encodeLineReflected is the default path: decode js into interface{} and
+// re-encode it as msgpack via codec's reflection-based encoder.
+func encodeLineReflected(mh *codec.MsgpackHandle, buf *bytes.Buffer, js []byte) error {
+	var jh codec.Handle = new(codec.JsonHandle)
+	dec := codec.NewDecoderBytes(js, jh)
+	var iface interface{}
+	if err := dec.Decode(&iface); err != nil {
+		return fmt.Errorf("Decode error: %s", err)
+	}
+
+	enc := codec.NewEncoder(buf, mh)
+	if err := enc.Encode(iface); err != nil {
+		return fmt.Errorf("Encoding error trying to encode iface='%#v': %s", iface, err)
+	}
+	return nil
+}
+
+// encodeLineViaSchema decodes js into a map and hands it to
+// cfg.schemaNew, which builds the schema's target struct and returns it
+// as a schema.Encoder; that encoder writes its own msgpack directly,
+// without reflection.
+func encodeLineViaSchema(cfg *JsonMsgpConfig, buf *bytes.Buffer, js []byte) error {
+	jh := new(codec.JsonHandle)
+	jh.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	dec := codec.NewDecoderBytes(js, jh)
+	var record map[string]interface{}
+	if err := dec.Decode(&record); err != nil {
+		return fmt.Errorf("Decode error: %s", err)
+	}
+
+	enc, err := cfg.schemaNew(record)
+	if err != nil {
+		return fmt.Errorf("schema error building encoder: %s", err)
+	}
+	if err := enc.EncodeMsg(buf); err != nil {
+		return fmt.Errorf("schema EncodeMsg error: %s", err)
+	}
+	return nil
+}
+
+// writeFramesInOrder drains in, holding out-of-order frameItems in a
+// reorder buffer keyed by line number, and writes them to cfg.Output in
+// strictly increasing line-number order. It returns the number of frames
+// written.
+func writeFramesInOrder(cfg *JsonMsgpConfig, in <-chan frameItem) (int64, error) {
+	pending := make(map[int64][]byte)
+	next := int64(1)
+
+	for item := range in {
+		pending[item.lineNum] = item.frame
+
+		for {
+			frame, ok := pending[next]
+			if !ok {
+				break
+			}
+			if _, err := cfg.Output.Write(frame); err != nil {
+				return next - 1, fmt.Errorf("writing to output '%s': %s", cfg.OutputPath, err)
+			}
+			delete(pending, next)
+			next++
+		}
+	}
+
+	written := next - 1
+	if len(pending) > 0 {
+		return written, fmt.Errorf("pipeline ended with %d frame(s) still buffered out of line-number order", len(pending))
+	}
+	return written, nil
+}
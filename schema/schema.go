@@ -0,0 +1,168 @@
+/*
+Package schema is the runtime half of json2msgpack's schema-driven typed
+encoding: it loads the plugin built by json2msgpack-gen from a user's
+struct definitions and exposes the reflection-free EncodeMsg method that
+plugin generates, so json2msgpack's encodeLineViaSchema can bypass
+interface{}-based msgpack
+encoding for known-shape records.
+
+The WriteMapHeader/WriteString/WriteInt64/WriteFloat64/WriteBool helpers
+below are what generated EncodeMsg methods call; they write msgpack's
+wire format directly, the same way framing.WriteBinArrayHeader writes a
+bin array header, so a generated encoder never reflects over its struct.
+
+Load's plugin build runs in module mode, and this repo has no go.mod of
+its own, so the schema directory passed to -schema must have its own
+go.mod with a "replace github.com/glycerine/json2msgpack => <path to
+this repo checkout>" directive; otherwise the generated file's import of
+this package won't resolve.
+*/
+package schema
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"plugin"
+	"strings"
+)
+
+// Encoder is implemented by a schema-generated struct: it writes its own
+// msgpack encoding directly to w, with no reflection.
+type Encoder interface {
+	EncodeMsg(w io.Writer) error
+}
+
+// NewFunc builds an Encoder for one decoded JSON record. It is the
+// symbol every json2msgpack-gen plugin must export under the name "New".
+type NewFunc func(record map[string]interface{}) (Encoder, error)
+
+// Load compiles the package in the directory containing the schema
+// source file at path into a Go plugin (written next to it as
+// <base>.so) and returns its exported NewFunc. The whole directory is
+// built, not just path itself, because the struct definition in path and
+// the EncodeMsg/New methods json2msgpack-gen generates alongside it (as
+// <base>_gen.go) are two files of the same package; building path alone
+// would leave New undefined. Compiling a plugin is slow relative to
+// encoding one record, so callers should call Load once at startup and
+// reuse the returned NewFunc, not call Load per record.
+func Load(path string) (NewFunc, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("schema.Load: resolving '%s': %s", path, err)
+	}
+	ext := filepath.Ext(absPath)
+	soPath := strings.TrimSuffix(absPath, ext) + ".so"
+	dir := filepath.Dir(absPath)
+
+	// cmd.Dir must be set to dir (rather than passing dir as the build
+	// target from json2msgpack's own working directory) so Go's module
+	// root detection runs against the schema's own go.mod, not whatever
+	// directory json2msgpack happened to be invoked from.
+	cmd := exec.Command("go", "build", "-buildmode=plugin", "-o", soPath, ".")
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("schema.Load: compiling '%s' as a plugin failed: %s", dir, err)
+	}
+
+	p, err := plugin.Open(soPath)
+	if err != nil {
+		return nil, fmt.Errorf("schema.Load: opening plugin '%s' failed: %s", soPath, err)
+	}
+
+	sym, err := p.Lookup("New")
+	if err != nil {
+		return nil, fmt.Errorf("schema.Load: plugin '%s' does not export 'New': %s", soPath, err)
+	}
+
+	newFunc, ok := sym.(func(map[string]interface{}) (Encoder, error))
+	if !ok {
+		return nil, fmt.Errorf("schema.Load: plugin '%s' exports 'New' with the wrong signature", soPath)
+	}
+
+	return NewFunc(newFunc), nil
+}
+
+// WriteMapHeader writes a msgpack map header announcing n key/value
+// pairs to follow.
+func WriteMapHeader(w io.Writer, n int) error {
+	var by [5]byte
+	var nBytesAdded int
+	switch {
+	case n < 16:
+		by[0] = 0x80 | byte(n) // fixmap
+		nBytesAdded = 1
+	case n < 65536:
+		by[0] = 0xde // map16
+		binary.BigEndian.PutUint16(by[1:3], uint16(n))
+		nBytesAdded = 3
+	default:
+		by[0] = 0xdf // map32
+		binary.BigEndian.PutUint32(by[1:5], uint32(n))
+		nBytesAdded = 5
+	}
+	_, err := w.Write(by[:nBytesAdded])
+	return err
+}
+
+// WriteString writes s as a msgpack string.
+func WriteString(w io.Writer, s string) error {
+	l := len(s)
+	var hdr [5]byte
+	var hdrLen int
+	switch {
+	case l < 32:
+		hdr[0] = 0xa0 | byte(l) // fixstr
+		hdrLen = 1
+	case l < 256:
+		hdr[0] = 0xd9 // str8
+		hdr[1] = byte(l)
+		hdrLen = 2
+	case l < 65536:
+		hdr[0] = 0xda // str16
+		binary.BigEndian.PutUint16(hdr[1:3], uint16(l))
+		hdrLen = 3
+	default:
+		hdr[0] = 0xdb // str32
+		binary.BigEndian.PutUint32(hdr[1:5], uint32(l))
+		hdrLen = 5
+	}
+	if _, err := w.Write(hdr[:hdrLen]); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// WriteInt64 writes v as a msgpack int.
+func WriteInt64(w io.Writer, v int64) error {
+	var by [9]byte
+	by[0] = 0xd3 // int64
+	binary.BigEndian.PutUint64(by[1:9], uint64(v))
+	_, err := w.Write(by[:9])
+	return err
+}
+
+// WriteFloat64 writes v as a msgpack float64.
+func WriteFloat64(w io.Writer, v float64) error {
+	var by [9]byte
+	by[0] = 0xcb // float64
+	binary.BigEndian.PutUint64(by[1:9], math.Float64bits(v))
+	_, err := w.Write(by[:9])
+	return err
+}
+
+// WriteBool writes v as a msgpack bool.
+func WriteBool(w io.Writer, v bool) error {
+	b := byte(0xc2) // false
+	if v {
+		b = 0xc3 // true
+	}
+	_, err := w.Write([]byte{b})
+	return err
+}